@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// EntryHandler replaces a single entry of the input archive with its own
+// logic for writing into w. It receives w directly (rather than a plain
+// io.Writer) because handlers such as processUsersJson or downloadPictures
+// may need to add entries beyond the one they're transforming (profile
+// pictures, attachment bodies, ...). wMu must be held for every
+// w.Create/w.CreateHeader call and the write that follows it, since
+// archive/zip.Writer isn't safe for concurrent use; handlers should do any
+// slow work (network requests, etc.) before taking the lock so it doesn't
+// serialize the rest of the archive behind them.
+type EntryHandler func(w *zip.Writer, wMu *sync.Mutex, header *zip.FileHeader, input io.Reader) error
+
+// TransformArchiveOptions configures TransformArchive.
+type TransformArchiveOptions struct {
+	// Concurrency caps how many entries are being read/handled at once.
+	// Defaults to 4.
+	Concurrency int
+
+	// MatchHandler, when set, is consulted for any entry whose name isn't a
+	// key in handlers. It lets callers handle entries by pattern (e.g. every
+	// channel's per-day message file) instead of by exact name. Returning
+	// nil falls back to a plain copy.
+	MatchHandler func(name string) EntryHandler
+}
+
+// TransformArchive copies every entry of the zip archive at in into a new
+// zip archive at out. Entries whose name has a handler in handlers, or for
+// which opts.MatchHandler returns one, are passed to it instead of being
+// copied verbatim; everything else is copied through unchanged, preserving
+// its original FileHeader. Up to opts.Concurrency entries are read (and, for
+// handled entries, processed) in parallel, so slow handler work like an HTTP
+// download overlaps with the rest of the archive being copied instead of
+// blocking it.
+func TransformArchive(in, out string, handlers map[string]EntryHandler, opts TransformArchiveOptions) error {
+	r, err := zip.OpenReader(in)
+	if err != nil {
+		return fmt.Errorf("could not open input archive for reading: %s: %s", in, err)
+	}
+	defer r.Close()
+
+	f, err := os.Create(out)
+	if err != nil {
+		return fmt.Errorf("could not open the output archive for writing: %s: %s", out, err)
+	}
+	defer f.Close()
+
+	w := zip.NewWriter(f)
+	var wMu sync.Mutex
+
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = 4
+	}
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	var firstErr error
+	var errMu sync.Mutex
+	recordErr := func(err error) {
+		if err == nil {
+			return
+		}
+		errMu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		errMu.Unlock()
+	}
+
+	for _, zf := range r.File {
+		sem <- struct{}{}
+		wg.Add(1)
+
+		go func(zf *zip.File) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			verbosePrintln(fmt.Sprintf("Processing file: %s\n", zf.Name))
+
+			input, err := zf.Open()
+			if err != nil {
+				recordErr(fmt.Errorf("failed to open %s in input archive: %s", zf.Name, err))
+				return
+			}
+			defer input.Close()
+
+			header := zf.FileHeader
+
+			handler, ok := handlers[zf.Name]
+			if !ok && opts.MatchHandler != nil {
+				handler = opts.MatchHandler(zf.Name)
+				ok = handler != nil
+			}
+			if ok {
+				recordErr(handler(w, &wMu, &header, input))
+				return
+			}
+
+			wMu.Lock()
+			outFile, err := w.CreateHeader(&header)
+			if err == nil {
+				_, err = io.Copy(outFile, input)
+			}
+			wMu.Unlock()
+			recordErr(err)
+		}(zf)
+	}
+
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+
+	return w.Close()
+}
@@ -0,0 +1,540 @@
+package cmd
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var exportMattermostCmd = &cobra.Command{
+	Use:   "export-mattermost",
+	Short: "Convert the export archive into a Mattermost bulk-import bundle",
+	RunE:  exportMattermost,
+}
+
+func init() {
+	registerLoggingFlags(exportMattermostCmd)
+}
+
+// mattermostUser is everything the bulk-import "user" and "post" lines need
+// out of a Slack users.json entry.
+type mattermostUser struct {
+	Id        string
+	Username  string
+	Email     string
+	ImagePath string
+}
+
+// mattermostChannel is everything the bulk-import "channel" line needs out
+// of a Slack channels.json entry.
+type mattermostChannel struct {
+	Id   string
+	Name string
+}
+
+// mattermostDM is a Slack direct-message conversation, as described by
+// dms.json: just a pair (or small group) of member user IDs.
+type mattermostDM struct {
+	Id      string
+	Members []string
+}
+
+// nonMessageSubtypes are Slack message subtypes that describe channel
+// events rather than an actual chat message, so they have nothing worth
+// carrying over into a Mattermost post.
+var nonMessageSubtypes = map[string]bool{
+	"channel_join":      true,
+	"channel_leave":     true,
+	"channel_topic":     true,
+	"channel_purpose":   true,
+	"channel_name":      true,
+	"channel_archive":   true,
+	"channel_unarchive": true,
+}
+
+func exportMattermost(cmd *cobra.Command, args []string) error {
+	r, err := zip.OpenReader(inputArchive)
+	if err != nil {
+		fmt.Printf("Could not open input archive for reading: %s\n", inputArchive)
+		os.Exit(1)
+	}
+	defer r.Close()
+
+	files := make(map[string]*zip.File, len(r.File))
+	for _, f := range r.File {
+		files[f.Name] = f
+	}
+
+	users, err := loadMattermostUsers(files)
+	if err != nil {
+		fmt.Printf("Failed to load users.json.\n\n%s", err)
+		os.Exit(1)
+	}
+	usersByID := make(map[string]mattermostUser, len(users))
+	for _, u := range users {
+		usersByID[u.Id] = u
+	}
+
+	channels, err := loadMattermostChannels(files)
+	if err != nil {
+		fmt.Printf("Failed to load channels.json.\n\n%s", err)
+		os.Exit(1)
+	}
+
+	dms, err := loadMattermostDMs(files)
+	if err != nil {
+		fmt.Printf("Failed to load dms.json.\n\n%s", err)
+		os.Exit(1)
+	}
+	dmsByID := make(map[string]mattermostDM, len(dms))
+	for _, dm := range dms {
+		dmsByID[dm.Id] = dm
+	}
+
+	bundle, err := newMattermostBundle(outputArchive)
+	if err != nil {
+		fmt.Printf("Could not open the output bundle for writing: %s\n\n%s", outputArchive, err)
+		os.Exit(1)
+	}
+	defer bundle.Close()
+
+	if err := bundle.WriteLine(map[string]interface{}{"type": "version", "version": 1}); err != nil {
+		fmt.Printf("Failed to write version line.\n\n%s", err)
+		os.Exit(1)
+	}
+
+	team := map[string]interface{}{
+		"name":              mattermostTeamName,
+		"display_name":      mattermostTeamName,
+		"type":              "O",
+		"allow_open_invite": false,
+	}
+	if err := bundle.WriteLine(map[string]interface{}{"type": "team", "team": team}); err != nil {
+		fmt.Printf("Failed to write team line.\n\n%s", err)
+		os.Exit(1)
+	}
+
+	for _, u := range users {
+		user := map[string]interface{}{
+			"username":     u.Username,
+			"email":        u.Email,
+			"auth_service": "",
+		}
+		if u.ImagePath != "" {
+			dataPath := path.Join("data", u.ImagePath)
+			if err := bundle.copyArchiveFile(files, u.ImagePath, dataPath); err == nil {
+				user["profile_image"] = dataPath
+			} else {
+				verboseLogf("Skipping profile image for %q: %s", u.Username, err)
+			}
+		}
+		if err := bundle.WriteLine(map[string]interface{}{"type": "user", "user": user}); err != nil {
+			fmt.Printf("Failed to write user %q.\n\n%s", u.Username, err)
+			os.Exit(1)
+		}
+	}
+
+	channelNames := make(map[string]string, len(channels))
+	for _, c := range channels {
+		channelNames[c.Id] = c.Name
+		channel := map[string]interface{}{
+			"team":         mattermostTeamName,
+			"name":         c.Name,
+			"display_name": c.Name,
+			"type":         "O",
+		}
+		if err := bundle.WriteLine(map[string]interface{}{"type": "channel", "channel": channel}); err != nil {
+			fmt.Printf("Failed to write channel %q.\n\n%s", c.Name, err)
+			os.Exit(1)
+		}
+	}
+
+	for _, dm := range dms {
+		var members []string
+		for _, uid := range dm.Members {
+			members = append(members, usernameOrID(usersByID, uid))
+		}
+		if err := bundle.WriteLine(map[string]interface{}{"type": "direct_channel", "direct_channel": map[string]interface{}{"members": members}}); err != nil {
+			fmt.Printf("Failed to write direct channel %q.\n\n%s", dm.Id, err)
+			os.Exit(1)
+		}
+	}
+
+	for _, zf := range r.File {
+		if !isChannelMessageFile(zf.Name) {
+			continue
+		}
+
+		channelDir := strings.SplitN(zf.Name, "/", 2)[0]
+
+		rc, err := zf.Open()
+		if err != nil {
+			fmt.Printf("Failed to open message file %s.\n\n%s", zf.Name, err)
+			os.Exit(1)
+		}
+
+		var messages []map[string]interface{}
+		err = json.NewDecoder(rc).Decode(&messages)
+		rc.Close()
+		if err != nil {
+			fmt.Printf("Failed to decode message file %s.\n\n%s", zf.Name, err)
+			os.Exit(1)
+		}
+
+		dm, isDM := dmsByID[channelDir]
+
+		for _, message := range messages {
+			if subtype, _ := message["subtype"].(string); nonMessageSubtypes[subtype] {
+				continue
+			}
+
+			ts, _ := message["ts"].(string)
+			userID, _ := message["user"].(string)
+			text, _ := message["text"].(string)
+
+			user, ok := usersByID[userID]
+			if !ok || user.Username == "" {
+				// Bot/integration messages (subtype "bot_message") carry a
+				// bot_id instead of a user and have no entry in users.json.
+				// mmctl rejects posts whose user doesn't resolve, so there's
+				// no valid line to emit for these.
+				verboseLogf("Skipping message with unresolved user %q", userID)
+				continue
+			}
+
+			var attachments []map[string]string
+			if rawFiles, ok := message["files"].([]interface{}); ok {
+				for _, rawFile := range rawFiles {
+					fileObj, ok := rawFile.(map[string]interface{})
+					if !ok {
+						continue
+					}
+					localPath, _ := fileObj["local_path"].(string)
+					if localPath == "" {
+						continue
+					}
+					dataPath := path.Join("data", localPath)
+					if err := bundle.copyArchiveFile(files, localPath, dataPath); err != nil {
+						verboseLogf("Skipping attachment %s: %s", localPath, err)
+						continue
+					}
+					attachments = append(attachments, map[string]string{"path": dataPath})
+				}
+			}
+
+			messageText := translateMrkdwn(text, usersByID, channelNames)
+			if messageText == "" && len(attachments) == 0 {
+				continue
+			}
+
+			post := map[string]interface{}{
+				"user":      user.Username,
+				"message":   messageText,
+				"create_at": slackTimestampToMillis(ts),
+			}
+			if len(attachments) > 0 {
+				post["attachments"] = attachments
+			}
+
+			if isDM {
+				var members []string
+				for _, uid := range dm.Members {
+					members = append(members, usernameOrID(usersByID, uid))
+				}
+				post["channel_members"] = members
+				if err := bundle.WriteLine(map[string]interface{}{"type": "direct_post", "direct_post": post}); err != nil {
+					fmt.Printf("Failed to write direct post.\n\n%s", err)
+					os.Exit(1)
+				}
+				continue
+			}
+
+			post["team"] = mattermostTeamName
+			post["channel"] = channelNames[channelDir]
+			if post["channel"] == "" {
+				post["channel"] = channelDir
+			}
+			if err := bundle.WriteLine(map[string]interface{}{"type": "post", "post": post}); err != nil {
+				fmt.Printf("Failed to write post.\n\n%s", err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	return nil
+}
+
+// mattermostTeamName is the team every imported channel and post is
+// attached to. A matching "team" line is emitted first so the import
+// creates it if it doesn't already exist.
+const mattermostTeamName = "imported-team"
+
+func usernameOrID(users map[string]mattermostUser, id string) string {
+	if u, ok := users[id]; ok && u.Username != "" {
+		return u.Username
+	}
+	return id
+}
+
+func loadMattermostUsers(files map[string]*zip.File) ([]mattermostUser, error) {
+	zf, ok := files["users.json"]
+	if !ok {
+		return nil, errors.New("users.json not found in input archive")
+	}
+
+	rc, err := zf.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var raw []map[string]interface{}
+	if err := json.NewDecoder(rc).Decode(&raw); err != nil {
+		return nil, err
+	}
+
+	users := make([]mattermostUser, 0, len(raw))
+	for _, u := range raw {
+		id, _ := u["id"].(string)
+		name, _ := u["name"].(string)
+		if id == "" || name == "" {
+			continue
+		}
+
+		var email, imagePath string
+		if profile, ok := u["profile"].(map[string]interface{}); ok {
+			email, _ = profile["email"].(string)
+			imagePath, _ = profile["image_path"].(string)
+		}
+
+		users = append(users, mattermostUser{Id: id, Username: name, Email: email, ImagePath: imagePath})
+	}
+
+	return users, nil
+}
+
+func loadMattermostChannels(files map[string]*zip.File) ([]mattermostChannel, error) {
+	zf, ok := files["channels.json"]
+	if !ok {
+		// Some exports (e.g. DM-only ones) don't have a channels.json.
+		return nil, nil
+	}
+
+	rc, err := zf.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var raw []map[string]interface{}
+	if err := json.NewDecoder(rc).Decode(&raw); err != nil {
+		return nil, err
+	}
+
+	channels := make([]mattermostChannel, 0, len(raw))
+	for _, c := range raw {
+		id, _ := c["id"].(string)
+		name, _ := c["name"].(string)
+		if id == "" || name == "" {
+			continue
+		}
+		channels = append(channels, mattermostChannel{Id: id, Name: name})
+	}
+
+	return channels, nil
+}
+
+func loadMattermostDMs(files map[string]*zip.File) ([]mattermostDM, error) {
+	zf, ok := files["dms.json"]
+	if !ok {
+		return nil, nil
+	}
+
+	rc, err := zf.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var raw []map[string]interface{}
+	if err := json.NewDecoder(rc).Decode(&raw); err != nil {
+		return nil, err
+	}
+
+	dms := make([]mattermostDM, 0, len(raw))
+	for _, d := range raw {
+		id, _ := d["id"].(string)
+		if id == "" {
+			continue
+		}
+
+		rawMembers, _ := d["members"].([]interface{})
+		var members []string
+		for _, m := range rawMembers {
+			if uid, ok := m.(string); ok {
+				members = append(members, uid)
+			}
+		}
+
+		dms = append(dms, mattermostDM{Id: id, Members: members})
+	}
+
+	return dms, nil
+}
+
+// slackTimestampToMillis converts a Slack message timestamp ("1234567890.123456")
+// into Unix milliseconds, as Mattermost's bulk import expects for create_at.
+func slackTimestampToMillis(ts string) int64 {
+	parts := strings.SplitN(ts, ".", 2)
+	secs, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	var millis int64
+	if len(parts) == 2 {
+		frac := parts[1]
+		if len(frac) > 3 {
+			frac = frac[:3]
+		}
+		for len(frac) < 3 {
+			frac += "0"
+		}
+		if v, err := strconv.ParseInt(frac, 10, 64); err == nil {
+			millis = v
+		}
+	}
+
+	return secs*1000 + millis
+}
+
+var (
+	mrkdwnChannelMentionRe = regexp.MustCompile(`<#([A-Z0-9]+)(?:\|([^>]*))?>`)
+	mrkdwnLinkRe           = regexp.MustCompile(`<(https?://[^|>]+)\|([^>]+)>`)
+	mrkdwnUserMentionRe    = regexp.MustCompile(`<@([A-Z0-9]+)(?:\|[^>]*)?>`)
+)
+
+// translateMrkdwn does a best-effort conversion of Slack mrkdwn to
+// Mattermost's flavor of markdown: user mentions, channel mentions and
+// labeled links. Anything else (bold/italic/code, which both flavors spell
+// the same way) is left untouched.
+func translateMrkdwn(text string, users map[string]mattermostUser, channelNames map[string]string) string {
+	text = mrkdwnChannelMentionRe.ReplaceAllStringFunc(text, func(m string) string {
+		sub := mrkdwnChannelMentionRe.FindStringSubmatch(m)
+		name := sub[2]
+		if name == "" {
+			name = channelNames[sub[1]]
+		}
+		if name == "" {
+			return m
+		}
+		return "~" + name
+	})
+
+	text = mrkdwnLinkRe.ReplaceAllStringFunc(text, func(m string) string {
+		sub := mrkdwnLinkRe.FindStringSubmatch(m)
+		return fmt.Sprintf("[%s](%s)", sub[2], sub[1])
+	})
+
+	text = mrkdwnUserMentionRe.ReplaceAllStringFunc(text, func(m string) string {
+		sub := mrkdwnUserMentionRe.FindStringSubmatch(m)
+		return "@" + usernameOrID(users, sub[1])
+	})
+
+	return text
+}
+
+// mattermostBundle accumulates a Mattermost bulk-import JSONL document plus
+// the data files (avatars, attachments) it references, and writes them out
+// as a single tar+gzip archive.
+type mattermostBundle struct {
+	f     *os.File
+	gz    *gzip.Writer
+	tw    *tar.Writer
+	jsonl bytes.Buffer
+}
+
+func newMattermostBundle(outPath string) (*mattermostBundle, error) {
+	f, err := os.Create(outPath)
+	if err != nil {
+		return nil, err
+	}
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	return &mattermostBundle{f: f, gz: gz, tw: tw}, nil
+}
+
+// WriteLine appends v, JSON-encoded, as one more line of the bundle's
+// bulk-export.jsonl.
+func (b *mattermostBundle) WriteLine(v interface{}) error {
+	enc, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	b.jsonl.Write(enc)
+	b.jsonl.WriteByte('\n')
+	return nil
+}
+
+// copyArchiveFile copies the entry named srcName out of files and into the
+// bundle at destName.
+func (b *mattermostBundle) copyArchiveFile(files map[string]*zip.File, srcName, destName string) error {
+	zf, ok := files[srcName]
+	if !ok {
+		return fmt.Errorf("%s not found in input archive", srcName)
+	}
+
+	rc, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if err := b.tw.WriteHeader(&tar.Header{
+		Name: destName,
+		Mode: 0644,
+		Size: int64(zf.UncompressedSize64),
+	}); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(b.tw, rc)
+	return err
+}
+
+// Close flushes the accumulated bulk-export.jsonl into the tar stream and
+// closes the underlying tar, gzip and file writers, in that order.
+func (b *mattermostBundle) Close() error {
+	if err := b.tw.WriteHeader(&tar.Header{
+		Name: "bulk-export.jsonl",
+		Mode: 0644,
+		Size: int64(b.jsonl.Len()),
+	}); err != nil {
+		return err
+	}
+	if _, err := b.tw.Write(b.jsonl.Bytes()); err != nil {
+		return err
+	}
+
+	if err := b.tw.Close(); err != nil {
+		return err
+	}
+	if err := b.gz.Close(); err != nil {
+		return err
+	}
+	return b.f.Close()
+}
@@ -0,0 +1,273 @@
+package cmd
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cobra"
+	"github.com/zachlatta/slack-advanced-exporter/internal/slackclient"
+)
+
+var (
+	attachmentsApiToken    string
+	attachmentsConcurrency int
+)
+
+var fetchAttachmentsCmd = &cobra.Command{
+	Use:   "fetch-attachments",
+	Short: "Fetch all file attachments and add them to the output archive",
+	RunE:  fetchAttachments,
+}
+
+func init() {
+	fetchAttachmentsCmd.PersistentFlags().StringVar(&attachmentsApiToken, "api-token", "", "Slack API token. Can be obtained here: https://api.slack.com/docs/oauth-test-tokens")
+	fetchAttachmentsCmd.PersistentFlags().IntVar(&attachmentsConcurrency, "concurrency", 4, "number of attachments to download in parallel")
+	fetchAttachmentsCmd.MarkPersistentFlagRequired("api-token")
+	registerLoggingFlags(fetchAttachmentsCmd)
+}
+
+func fetchAttachments(cmd *cobra.Command, args []string) error {
+	// If a previous (presumably partial) output archive exists, reuse any
+	// attachments it already downloaded instead of fetching them again.
+	// TransformArchive truncates outputArchive in place (os.Create), so the
+	// existing file has to be staged aside first - reading it lazily via
+	// zip.File.Open, further down, would otherwise read back zeroes or EOF
+	// once TransformArchive opens the same path for writing.
+	existing := map[string]*zip.File{}
+	if resumeFrom, err := stageExistingOutputArchive(outputArchive); err != nil {
+		fmt.Printf("Failed to stage existing output archive for resume: %s\n\n%s", outputArchive, err)
+		os.Exit(1)
+	} else if resumeFrom != "" {
+		defer os.Remove(resumeFrom)
+
+		old, err := zip.OpenReader(resumeFrom)
+		if err != nil {
+			fmt.Printf("Failed to open staged copy of existing output archive: %s\n\n%s", resumeFrom, err)
+			os.Exit(1)
+		}
+		defer old.Close()
+
+		for _, file := range old.File {
+			if strings.HasPrefix(file.Name, "attachments/") {
+				existing[file.Name] = file
+			}
+		}
+		verboseLogf("Found %d attachment(s) in existing output archive; will skip re-downloading them.", len(existing))
+	}
+
+	client := slackclient.New(attachmentsApiToken)
+	client.Log = logEvent
+
+	tracker := newAttachmentTracker()
+
+	handlers := map[string]EntryHandler{}
+	opts := TransformArchiveOptions{
+		Concurrency: attachmentsConcurrency,
+		MatchHandler: func(name string) EntryHandler {
+			if !isChannelMessageFile(name) {
+				return nil
+			}
+			return func(w *zip.Writer, wMu *sync.Mutex, header *zip.FileHeader, input io.Reader) error {
+				return rewriteChannelMessages(w, wMu, header, input, client, existing, tracker)
+			}
+		},
+	}
+
+	if err := TransformArchive(inputArchive, outputArchive, handlers, opts); err != nil {
+		fmt.Printf("Failed to fetch attachments.\n\n%s", err)
+		os.Exit(1)
+	}
+
+	return nil
+}
+
+// stageExistingOutputArchive copies path aside to a temp file and returns its
+// path, so callers can keep reading from it even after path itself gets
+// truncated (as TransformArchive's os.Create(out) does). Returns "" with no
+// error if path doesn't exist yet, since there's nothing to resume from.
+func stageExistingOutputArchive(path string) (string, error) {
+	in, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".resume-*")
+	if err != nil {
+		return "", err
+	}
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, in); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	return tmp.Name(), nil
+}
+
+// attachmentTracker records which attachment paths have already been
+// written to the output archive during this run. Slack reuses the same
+// file id (and so the same attachmentPath) across every channel a file was
+// shared to, and channel files are processed concurrently, so without this
+// each channel's copy would re-download the file and write a duplicate zip
+// entry.
+type attachmentTracker struct {
+	mu      sync.Mutex
+	written map[string]bool
+}
+
+func newAttachmentTracker() *attachmentTracker {
+	return &attachmentTracker{written: map[string]bool{}}
+}
+
+// claim reports whether path hasn't been written yet this run, marking it
+// as written if so. Callers that get false back should skip writing
+// entirely - another goroutine already has, or is about to.
+func (t *attachmentTracker) claim(path string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.written[path] {
+		return false
+	}
+	t.written[path] = true
+	return true
+}
+
+// isChannelMessageFile reports whether name looks like a per-day message
+// export file (e.g. "general/2019-01-02.json") rather than one of the
+// top-level files such as users.json or channels.json.
+func isChannelMessageFile(name string) bool {
+	return strings.Contains(name, "/") && strings.HasSuffix(name, ".json")
+}
+
+// rewriteChannelMessages decodes a channel's day-file, fetches every file
+// attachment referenced by its messages (filling in local_path on each one),
+// and writes both the attachments and the rewritten JSON into w.
+func rewriteChannelMessages(w *zip.Writer, wMu *sync.Mutex, header *zip.FileHeader, input io.Reader, client *slackclient.Client, existing map[string]*zip.File, tracker *attachmentTracker) error {
+	var messages []map[string]interface{}
+	if err := json.NewDecoder(input).Decode(&messages); err != nil {
+		return err
+	}
+
+	for _, message := range messages {
+		rawFiles, ok := message["files"].([]interface{})
+		if !ok {
+			continue
+		}
+
+		for _, rawFile := range rawFiles {
+			fileObj, ok := rawFile.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			fileID, _ := fileObj["id"].(string)
+			name, _ := fileObj["name"].(string)
+			url, _ := fileObj["url_private_download"].(string)
+			if fileID == "" || url == "" {
+				continue
+			}
+			if name == "" {
+				name = fileID
+			}
+
+			attachmentPath := path.Join("attachments", fileID, name)
+			fileObj["local_path"] = attachmentPath
+
+			if err := fetchOneAttachment(w, wMu, client, attachmentPath, name, fileID, url, existing, tracker); err != nil {
+				return err
+			}
+		}
+	}
+
+	wMu.Lock()
+	defer wMu.Unlock()
+
+	outFile, err := w.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(outFile)
+	// The same indent level as export zip uses.
+	enc.SetIndent("", "    ")
+	return enc.Encode(&messages)
+}
+
+// fetchOneAttachment writes the attachment identified by fileID into the
+// output archive at attachmentPath, either by copying it forward from an
+// existing output archive (resume) or by downloading it fresh from Slack.
+// If attachmentPath has already been claimed by another call this run (a
+// file shared to more than one channel), it's a no-op: the entry is
+// already in the output archive, or on its way there.
+func fetchOneAttachment(w *zip.Writer, wMu *sync.Mutex, client *slackclient.Client, attachmentPath, name, fileID, url string, existing map[string]*zip.File, tracker *attachmentTracker) error {
+	if !tracker.claim(attachmentPath) {
+		verboseLogf("Attachment %s already written this run (shared across channels), skipping.", attachmentPath)
+		return nil
+	}
+
+	if old, ok := existing[attachmentPath]; ok {
+		verboseLogf("Attachment %s already present in output archive, skipping download.", attachmentPath)
+		oldReader, err := old.Open()
+		if err != nil {
+			return fmt.Errorf("failed to open existing attachment %s: %s", attachmentPath, err)
+		}
+		defer oldReader.Close()
+
+		wMu.Lock()
+		defer wMu.Unlock()
+		outFile, err := w.Create(attachmentPath)
+		if err != nil {
+			return fmt.Errorf("failed to create attachment %s in output archive: %s", attachmentPath, err)
+		}
+		_, err = io.Copy(outFile, oldReader)
+		return err
+	}
+
+	logEvent("info", map[string]interface{}{"file_id": fileID}, "Downloading attachment %q (%s)", name, fileID)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("got error %s when building the request", err.Error())
+	}
+	req.Header.Set("Authorization", "Bearer "+attachmentsApiToken)
+
+	// The download itself goes through client's shared Tier4 limiter, so it
+	// draws from the same budget as every other attachment download in this
+	// run.
+	resp, err := client.Do(context.Background(), slackclient.Tier4, req)
+	if err != nil {
+		return fmt.Errorf("failed to download attachment %s: %s", url, err)
+	}
+
+	// Buffer the body before taking wMu, so the network transfer overlaps
+	// with whatever else is holding the lock instead of serializing behind
+	// it.
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read attachment body %s: %s", url, err)
+	}
+
+	wMu.Lock()
+	defer wMu.Unlock()
+	outFile, err := w.Create(attachmentPath)
+	if err != nil {
+		return fmt.Errorf("failed to create attachment %s in output archive: %s", attachmentPath, err)
+	}
+	_, err = outFile.Write(body)
+	return err
+}
@@ -2,15 +2,17 @@ package cmd
 
 import (
 	"archive/zip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 
 	"github.com/spf13/cobra"
+	"github.com/zachlatta/slack-advanced-exporter/internal/slackclient"
 )
 
 var fetchProfilePicturesCmd = &cobra.Command{
@@ -21,71 +23,30 @@ var fetchProfilePicturesCmd = &cobra.Command{
 
 func init() {
 	fetchProfilePicturesCmd.PersistentFlags()
+	registerLoggingFlags(fetchProfilePicturesCmd)
 }
 
 func fetchProfilePics(cmd *cobra.Command, args []string) error {
-	// Open the input archive.
-	r, err := zip.OpenReader(inputArchive)
-	if err != nil {
-		fmt.Printf("Could not open input archive for reading: %s\n", inputArchive)
-		os.Exit(1)
+	// Profile pictures are served from a public CDN, so the client doesn't
+	// need a Slack API token - it's only here for the shared rate limiter.
+	client := slackclient.New("")
+	client.Log = logEvent
+
+	handlers := map[string]EntryHandler{
+		"users.json": func(w *zip.Writer, wMu *sync.Mutex, header *zip.FileHeader, input io.Reader) error {
+			return downloadPictures(w, wMu, header, input, client)
+		},
 	}
-	defer r.Close()
 
-	// Open the output archive.
-	f, err := os.Create(outputArchive)
-	if err != nil {
-		fmt.Printf("Could not open the output archive for writing: %s\n\n%s", outputArchive, err)
+	if err := TransformArchive(inputArchive, outputArchive, handlers, TransformArchiveOptions{}); err != nil {
+		fmt.Printf("Failed to fetch users' profile pictures.\n\n%s", err)
 		os.Exit(1)
 	}
-	defer f.Close()
-
-	// Create a zip writer on the output archive.
-	w := zip.NewWriter(f)
-
-	// Run through all the files in the input archive.
-	for _, file := range r.File {
-		verbosePrintln(fmt.Sprintf("Processing file: %s\n", file.Name))
-
-		// Open the file from the input archive.
-		inReader, err := file.Open()
-		if err != nil {
-			fmt.Printf("Failed to open file in input archive: %s\n\n%s", file.Name, err)
-			os.Exit(1)
-		}
-
-		if file.Name == "users.json" {
-			err = downloadPictures(inReader, w)
-			if err != nil {
-				fmt.Printf("Failed to fetch users' profile pictures.\n\n%s", err)
-				os.Exit(1)
-			}
-		} else {
-			// Copy, because CreateHeader modifies it.
-			header := file.FileHeader
-			outFile, err := w.CreateHeader(&header)
-			if err != nil {
-				fmt.Printf("Failed to create file in output archive: %s\n\n%s", file.Name, err)
-				os.Exit(1)
-			}
-			_, err = io.Copy(outFile, inReader)
-			if err != nil {
-				fmt.Printf("Failed to copy file to output archive: %s\n\n%s", file.Name, err)
-				os.Exit(1)
-			}
-		}
-	}
-
-	// Close the output zip writer.
-	err = w.Close()
-	if err != nil {
-		fmt.Printf("Failed to close the output archive.\n\n%s", err)
-	}
 
 	return nil
 }
 
-func downloadPictures(input io.Reader, w *zip.Writer) error {
+func downloadPictures(w *zip.Writer, wMu *sync.Mutex, header *zip.FileHeader, input io.Reader, client *slackclient.Client) error {
 	verbosePrintln("Found users.json file.")
 
 	// We want to preserve all existing fields in JSON.
@@ -97,6 +58,9 @@ func downloadPictures(input io.Reader, w *zip.Writer) error {
 
 	verbosePrintln("Updating users.json contents with fetched pictures.")
 
+	bar := newByteBar("Downloading profile pictures", 0)
+	defer bar.Finish()
+
 	for _, user := range data {
 		name, _ := user["name"].(string)
 
@@ -112,38 +76,52 @@ func downloadPictures(input io.Reader, w *zip.Writer) error {
 					if err != nil {
 						return fmt.Errorf("Got error %s when building the request", err.Error())
 					}
-					log.Printf("Downloading profile picture for %q", name)
+					logEvent("info", map[string]interface{}{"user_id": userid}, "Downloading profile picture for %q", name)
 
-					response, err := httpClient.Do(req)
+					response, err := client.Do(context.Background(), slackclient.Tier4, req)
 					if err != nil {
-						log.Printf("Failed to download profile picture for user %q from %s", userid, imageURL)
+						logEvent("error", map[string]interface{}{"user_id": userid}, "Failed to download profile picture for user %q from %s", userid, imageURL)
+						continue
+					}
+
+					// Buffer the body before taking wMu, so the network
+					// transfer overlaps with whatever else is holding the
+					// lock instead of serializing behind it.
+					body, err := io.ReadAll(bar.NewProxyReader(response.Body))
+					response.Body.Close()
+					if err != nil {
+						logEvent("error", map[string]interface{}{"user_id": userid}, "Failed to download profile picture body for %q from %s: %s", userid, imageURL, err)
 						continue
 					}
-					defer response.Body.Close()
 
 					picFileName := "profile_pictures/" + userid + extension
 					profile["image_path"] = picFileName
 
-					// Save the file to the output zip file.
+					wMu.Lock()
 					outFile, err := w.Create(picFileName)
 					if err != nil {
+						wMu.Unlock()
 						return fmt.Errorf("Failed to write profile picture to zip file for %q from %s", userid, imageURL)
 					}
-					_, err = io.Copy(outFile, response.Body)
+					_, err = outFile.Write(body)
+					wMu.Unlock()
 					if err != nil {
-						log.Print("++++++ Failed to write the downloaded file to the output archive: " + imageURL + "\n\n" + err.Error() + "\n")
+						logEvent("error", map[string]interface{}{"user_id": userid}, "Failed to write the downloaded file to the output archive: %s: %s", imageURL, err)
 					}
 				} else {
-					log.Printf("Skipping %q, no suitable profile picture found", userid)
+					logEvent("info", map[string]interface{}{"user_id": userid}, "Skipping %q, no suitable profile picture found", userid)
 				}
 			} else {
-				log.Printf("User %q doesn't have 'profile' in JSON file (unexpected error!)", userid)
+				logEvent("warn", map[string]interface{}{"user_id": userid}, "User %q doesn't have 'profile' in JSON file (unexpected error!)", userid)
 			}
 		} else {
-			log.Print("Some user array entry doesn't have id, skipping")
+			logEvent("warn", nil, "Some user array entry doesn't have id, skipping")
 		}
 	}
 
+	wMu.Lock()
+	defer wMu.Unlock()
+
 	file, err := w.Create("users.json")
 	if err != nil {
 		return fmt.Errorf("Failed to write users.json back to archive")
@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"github.com/cheggaaa/pb/v3"
+)
+
+// newCounterBar returns a progress bar suited to counting discrete steps
+// (e.g. users.list pages) rather than bytes. It's a no-op bar - one that's
+// never started - when --no-progress or --silent was passed, so callers can
+// always call Increment/Finish on the result unconditionally.
+func newCounterBar(message string) *pb.ProgressBar {
+	bar := pb.New(0)
+	bar.Set(pb.Bytes, false)
+	bar.SetTemplateString(`{{ green "` + message + `:" }} {{counters . }} {{speed . "%s/s"}}`)
+
+	if noProgress || silent {
+		return bar
+	}
+	return bar.Start()
+}
+
+// newByteBar returns a progress bar for a download of total bytes (0 if
+// unknown), showing ETA and throughput once a total is known. It's a no-op
+// bar when --no-progress or --silent was passed.
+func newByteBar(message string, total int64) *pb.ProgressBar {
+	bar := pb.New64(total)
+	bar.Set(pb.Bytes, true)
+	if total > 0 {
+		bar.SetTemplateString(`{{ green "` + message + `:" }} {{counters . }} {{speed . }} {{etime . }} ETA {{rtime . }}`)
+	} else {
+		bar.SetTemplateString(`{{ green "` + message + `:" }} {{counters . }} {{speed . }}`)
+	}
+
+	if noProgress || silent {
+		return bar
+	}
+	return bar.Start()
+}
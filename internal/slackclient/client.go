@@ -0,0 +1,152 @@
+// Package slackclient centralizes the pieces every command that talks to
+// Slack's API needs: bearer-token injection for API calls, a token-bucket
+// limiter per Slack rate-limit tier, and retry/backoff that understands
+// Slack's 429 Retry-After header. It intentionally does not inject the
+// bearer token into arbitrary requests passed to Do, since callers also use
+// it to fetch files from hosts (avatar/file CDNs) that shouldn't see the
+// Slack API token.
+package slackclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Tier identifies one of Slack's documented rate-limit tiers. Each Client
+// keeps a separate token bucket per tier so a slow endpoint doesn't steal
+// budget from a fast one.
+type Tier int
+
+const (
+	// Tier2 covers endpoints like users.list: roughly 20 requests/minute.
+	Tier2 Tier = iota
+	// Tier4 covers endpoints like conversations.history, and is also used
+	// for file downloads routed through Client.Do: roughly 100 requests/minute.
+	Tier4
+)
+
+const maxRetries = 5
+
+// Client is a small wrapper around http.Client that adds Slack-aware rate
+// limiting and retry/backoff. The zero value is not usable; use New.
+type Client struct {
+	http     *http.Client
+	token    string
+	limiters map[Tier]*rate.Limiter
+
+	// Log, if set, is called for every retry/backoff decision Do makes, so
+	// callers can surface it through their own logging (request IDs,
+	// --log-json, ...). It defaults to a no-op.
+	Log func(level string, fields map[string]interface{}, format string, args ...interface{})
+}
+
+// New returns a Client that authenticates API requests built with
+// NewAPIRequest using token. token may be empty for a Client that's only
+// ever used to download files that don't need Slack auth.
+func New(token string) *Client {
+	return &Client{
+		http:  &http.Client{},
+		token: token,
+		limiters: map[Tier]*rate.Limiter{
+			Tier2: rate.NewLimiter(rate.Every(time.Minute/20), 1),
+			Tier4: rate.NewLimiter(rate.Every(time.Minute/100), 1),
+		},
+		Log: func(string, map[string]interface{}, string, ...interface{}) {},
+	}
+}
+
+// NewAPIRequest builds a GET request against https://slack.com/api/<method>,
+// with params as the query string and the client's token set as a bearer
+// Authorization header.
+func (c *Client) NewAPIRequest(ctx context.Context, method string, params url.Values) (*http.Request, error) {
+	endpoint := "https://slack.com/api/" + method + "?" + params.Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	return req, nil
+}
+
+// Do issues req, waiting on tier's token bucket first and retrying on
+// Slack's 429 responses (honoring Retry-After) and on transient 5xx/network
+// errors. It never modifies req's headers, so it's safe to use for
+// downloads that must not carry the Slack API token (e.g. CDN-hosted
+// avatars).
+func (c *Client) Do(ctx context.Context, tier Tier, req *http.Request) (*http.Response, error) {
+	limiter, ok := c.limiters[tier]
+	if !ok {
+		return nil, fmt.Errorf("slackclient: unknown rate-limit tier %d", tier)
+	}
+
+	for attempt := 0; ; attempt++ {
+		if err := limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+
+		resp, err := c.http.Do(req)
+		if err != nil {
+			if attempt >= maxRetries {
+				return nil, err
+			}
+			d := backoff(attempt)
+			c.Log("warn", map[string]interface{}{"url": req.URL.String(), "attempt": attempt + 1}, "network error on %s: %v; retrying in %s", req.URL, err, d)
+			time.Sleep(d)
+			continue
+		}
+
+		if resp.StatusCode == http.StatusTooManyRequests {
+			wait := retryAfter(resp.Header.Get("Retry-After"))
+			resp.Body.Close()
+			c.Log("warn", map[string]interface{}{"url": req.URL.String(), "attempt": attempt + 1}, "rate limited on %s; waiting %s", req.URL, wait)
+			time.Sleep(wait)
+			continue
+		}
+
+		if resp.StatusCode >= 500 {
+			resp.Body.Close()
+			if attempt >= maxRetries {
+				return nil, fmt.Errorf("slackclient: got HTTP %d from %s after %d attempts", resp.StatusCode, req.URL, attempt+1)
+			}
+			d := backoff(attempt)
+			c.Log("warn", map[string]interface{}{"url": req.URL.String(), "attempt": attempt + 1}, "server error %d on %s; retrying in %s", resp.StatusCode, req.URL, d)
+			time.Sleep(d)
+			continue
+		}
+
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			resp.Body.Close()
+			return nil, fmt.Errorf("slackclient: got HTTP %d from %s: %s", resp.StatusCode, req.URL, strings.TrimSpace(string(body)))
+		}
+
+		return resp, nil
+	}
+}
+
+func backoff(attempt int) time.Duration {
+	shift := attempt
+	if shift > 3 {
+		shift = 3
+	}
+	return time.Duration(1<<shift) * time.Second
+}
+
+func retryAfter(header string) time.Duration {
+	if header == "" {
+		return time.Second
+	}
+	secs, err := strconv.Atoi(header)
+	if err != nil {
+		return time.Second
+	}
+	return time.Duration(secs) * time.Second
+}
@@ -0,0 +1,60 @@
+package slackclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+)
+
+// CursorPage is implemented by any response type decoded by Paginate, so it
+// can report Slack's response_metadata.next_cursor without Paginate needing
+// to know the shape of the rest of the page.
+type CursorPage interface {
+	NextCursor() string
+}
+
+// Paginate drives method (e.g. "users.list") through every page, decoding
+// each response as a T and handing it to onPage. T must implement
+// CursorPage; Paginate follows response_metadata.next_cursor itself and
+// stops once a page reports an empty cursor, so callers can't forget to
+// thread it through. params is reused as the base query string for every
+// page, with "cursor" added/overwritten as needed.
+func Paginate[T CursorPage](ctx context.Context, c *Client, tier Tier, method string, params url.Values, onPage func(T) error) error {
+	cursor := ""
+
+	for {
+		v := url.Values{}
+		for k, vals := range params {
+			v[k] = vals
+		}
+		if cursor != "" {
+			v.Set("cursor", cursor)
+		}
+
+		req, err := c.NewAPIRequest(ctx, method, v)
+		if err != nil {
+			return err
+		}
+
+		resp, err := c.Do(ctx, tier, req)
+		if err != nil {
+			return err
+		}
+
+		var page T
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		if err := onPage(page); err != nil {
+			return err
+		}
+
+		cursor = page.NextCursor()
+		if cursor == "" {
+			return nil
+		}
+	}
+}